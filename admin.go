@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// NewAdminServer builds the admin HTTP server exposing /status (awaiting
+// and in-flight granules) and /cancel/{id} (cancel an in-flight granule).
+// Prometheus scraping is served separately by NewMetricsServer, so it
+// doesn't require enabling this debug-oriented endpoint.
+func NewAdminServer(addr string, tracker *Tracker) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tracker.Status())
+	})
+	mux.HandleFunc("/cancel/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/cancel/")
+		if "" == id {
+			http.Error(w, "missing granule id", http.StatusBadRequest)
+			return
+		}
+		if !tracker.Cancel(id) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	return &http.Server{Addr: addr, Handler: mux}
+}
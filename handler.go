@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"text/template"
+
+	"go.uber.org/zap"
+)
+
+var ShellHandlerFailed = errors.New("Shell handler command failed.")
+
+// Handler post-processes a completed granule. The built-in detect/fit
+// pipeline, a user-supplied shell command, and chains of either are all
+// Handlers.
+type Handler interface {
+	Handle(ctx context.Context, s *State) error
+}
+
+// ChainHandler runs its Handlers in order, aborting on the first error.
+type ChainHandler []Handler
+
+func (c ChainHandler) Handle(ctx context.Context, s *State) error {
+	for _, h := range c {
+		if err := h.Handle(ctx, s); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// DetectFitHandler wraps the existing viirs_detect/viirs_fit pipeline so it
+// can be registered like any other Handler.
+type DetectFitHandler struct {
+	Config *Config
+}
+
+func (h *DetectFitHandler) Handle(ctx context.Context, s *State) error {
+	return h.Config.Process(ctx, s)
+}
+
+// ShellHandler runs Command, a text/template string, against a completed
+// granule. {{.Id}}, {{.M10File}} and {{.Files}} are available to the
+// template.
+type ShellHandler struct {
+	Command string
+}
+
+type shellVars struct {
+	Id      string
+	M10File string
+	Files   string
+}
+
+func (h *ShellHandler) Handle(ctx context.Context, s *State) error {
+	tmpl, err := template.New("shell").Parse(h.Command)
+	if nil != err {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, shellVars{s.Id, s.M10File, strings.Join(s.Files, " ")}); nil != err {
+		return err
+	}
+	fields := strings.Fields(buf.String())
+	if 0 == len(fields) {
+		return ShellHandlerFailed
+	}
+	cmd := exec.CommandContext(ctx, fields[0], fields[1:]...)
+	out, err := cmd.CombinedOutput()
+	if nil != err {
+		granuleLogger(s).Warn("ShellHandler failed", zap.ByteString("output", out))
+		return ShellHandlerFailed
+	}
+	return nil
+}
+
+// HandlerSpec is the JSON shape a Handler is configured with; Build turns
+// it into a live Handler once the owning Config has been decoded.
+type HandlerSpec struct {
+	Type    string
+	Command string
+	Chain   []HandlerSpec
+}
+
+func (spec HandlerSpec) Build(cfg *Config) (Handler, error) {
+	switch spec.Type {
+	case "", "viirs":
+		return &DetectFitHandler{Config: cfg}, nil
+	case "shell":
+		return &ShellHandler{Command: spec.Command}, nil
+	case "chain":
+		var chain ChainHandler
+		for _, sub := range spec.Chain {
+			h, err := sub.Build(cfg)
+			if nil != err {
+				return nil, err
+			}
+			chain = append(chain, h)
+		}
+		return chain, nil
+	}
+	return nil, fmt.Errorf("viirs_watcher: unknown handler type %q", spec.Type)
+}
+
+// HandlerRule maps a glob Pattern, matched against a granule's M10File, to
+// the Handler that should process it.
+type HandlerRule struct {
+	Pattern string
+	Handler HandlerSpec
+
+	handler Handler
+}
+
+// BuildHandlers compiles every configured HandlerRule into a live Handler.
+// Call it once after Constrain.
+func (c *Config) BuildHandlers() error {
+	for i := range c.Handlers {
+		h, err := c.Handlers[i].Handler.Build(c)
+		if nil != err {
+			return err
+		}
+		c.Handlers[i].handler = h
+	}
+	return nil
+}
+
+// HandlerFor returns the Handler configured for s, falling back to the
+// built-in detect/fit pipeline if no rule matches its M10File.
+func (c *Config) HandlerFor(s *State) Handler {
+	for _, rule := range c.Handlers {
+		if matchPattern(rule.Pattern, s.M10File) {
+			return rule.handler
+		}
+	}
+	return &DetectFitHandler{Config: c}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	xp "gopkg.in/xmlpath.v2"
+
+	"go.uber.org/zap"
+)
+
+var NativeReadFailed = errors.New("Native HDF5 reader failed to open file.")
+
+// BoundingBox is a granule's geolocation extent, in degrees.
+type BoundingBox struct {
+	MinLat, MaxLat, MinLon, MaxLon float64
+}
+
+// Intersects reports whether bb and other overlap.
+func (bb BoundingBox) Intersects(other BoundingBox) bool {
+	return bb.MinLat <= other.MaxLat && bb.MaxLat >= other.MinLat &&
+		bb.MinLon <= other.MaxLon && bb.MaxLon >= other.MinLon
+}
+
+// GranuleMeta describes the attributes an HDF5Reader pulls out of an
+// SVM10 file, so downstream Handlers can filter granules (e.g. by AOI)
+// without reopening the file themselves.
+type GranuleMeta struct {
+	Night       bool
+	StartTime   time.Time
+	EndTime     time.Time
+	OrbitNumber int
+	BoundingBox BoundingBox
+}
+
+// HDF5Reader reads granule attributes out of an SVM10 file.
+type HDF5Reader interface {
+	Read(path string) (GranuleMeta, error)
+}
+
+// H5DumpReader shells out to h5dump, same as the original day/night check.
+// It's the portable, fork+exec-per-granule fallback.
+type H5DumpReader struct {
+	Binary string
+}
+
+func (r *H5DumpReader) Read(path string) (GranuleMeta, error) {
+	h5dump := exec.Command(r.Binary, "-x", "-A", path)
+	out, err := h5dump.Output()
+	if nil != err {
+		logger.Warn("h5dump failed", zap.String("path", path), zap.Error(err))
+		return GranuleMeta{}, NightCheckFailed
+	}
+	meta := GranuleMeta{Night: strings.Contains(string(out), "Descending_Indicator")}
+	root, err := xp.Parse(strings.NewReader(string(out)))
+	if nil != err {
+		logger.Warn("h5dump output did not parse as XML, granule metadata unavailable", zap.String("path", path), zap.Error(err))
+		return meta, nil
+	}
+	populateGranuleMeta(&meta, root, path)
+	return meta, nil
+}
+
+// populateGranuleMeta fills the start/end time, orbit number, and bounding
+// box of meta from the h5dump -x XML attribute tree rooted at root. Each
+// attribute is independent and best-effort: a missing or malformed one is
+// logged and left zero rather than failing the whole read, since only
+// Night gates whether a granule is processed at all.
+func populateGranuleMeta(meta *GranuleMeta, root *xp.Node, path string) {
+	beginDate, _ := attrText(root, "Beginning_Date")
+	beginTime, _ := attrText(root, "Beginning_Time")
+	if start, err := parseGranuleTime(beginDate, beginTime); nil == err {
+		meta.StartTime = start
+	} else if "" != beginDate || "" != beginTime {
+		logger.Warn("failed to parse granule start time", zap.String("path", path), zap.Error(err))
+	}
+
+	endDate, _ := attrText(root, "Ending_Date")
+	endTime, _ := attrText(root, "Ending_Time")
+	if end, err := parseGranuleTime(endDate, endTime); nil == err {
+		meta.EndTime = end
+	} else if "" != endDate || "" != endTime {
+		logger.Warn("failed to parse granule end time", zap.String("path", path), zap.Error(err))
+	}
+
+	if orbit, ok := attrText(root, "N_Beginning_Orbit_Number"); ok {
+		if n, err := fmt.Sscanf(orbit, "%d", &meta.OrbitNumber); nil != err || 1 != n {
+			logger.Warn("failed to parse orbit number", zap.String("path", path), zap.String("value", orbit))
+		}
+	}
+
+	meta.BoundingBox.MaxLat = attrFloat(root, "North_Bounding_Coordinate", path)
+	meta.BoundingBox.MinLat = attrFloat(root, "South_Bounding_Coordinate", path)
+	meta.BoundingBox.MaxLon = attrFloat(root, "East_Bounding_Coordinate", path)
+	meta.BoundingBox.MinLon = attrFloat(root, "West_Bounding_Coordinate", path)
+}
+
+// attrText returns the text of the first Attribute in root whose Name
+// contains name, and whether it was found.
+func attrText(root *xp.Node, name string) (string, bool) {
+	path, err := xp.Compile(fmt.Sprintf("//Attribute[contains(@Name, '%s')]/Data/DataFromFile", name))
+	if nil != err {
+		return "", false
+	}
+	iter := path.Iter(root)
+	if !iter.Next() {
+		return "", false
+	}
+	return strings.TrimSpace(iter.Node().String()), true
+}
+
+// attrFloat returns the parsed float value of the first Attribute in root
+// whose Name contains name, or zero if it's missing or malformed.
+func attrFloat(root *xp.Node, name, path string) float64 {
+	text, ok := attrText(root, name)
+	if !ok {
+		return 0
+	}
+	var v float64
+	if n, err := fmt.Sscanf(text, "%g", &v); nil != err || 1 != n {
+		logger.Warn("failed to parse bounding coordinate", zap.String("path", path), zap.String("attr", name), zap.String("value", text))
+		return 0
+	}
+	return v
+}
+
+// parseGranuleTime combines a VIIRS SDR "yyyymmdd" date attribute and
+// "hhmmss.ffffffZ" time attribute into a UTC time.Time.
+func parseGranuleTime(date, clock string) (time.Time, error) {
+	if "" == date || "" == clock {
+		return time.Time{}, fmt.Errorf("viirs_watcher: missing date or time attribute")
+	}
+	clock = strings.TrimSuffix(strings.TrimSpace(clock), "Z")
+	if i := strings.Index(clock, "."); i >= 0 {
+		clock = clock[:i]
+	}
+	return time.Parse("20060102 150405", strings.TrimSpace(date)+" "+clock)
+}
+
+// FallbackHDF5Reader tries Primary first, falling back to Secondary if
+// Primary fails to open the file (e.g. the native reader can't be used
+// for this granule).
+type FallbackHDF5Reader struct {
+	Primary   HDF5Reader
+	Secondary HDF5Reader
+}
+
+func (r *FallbackHDF5Reader) Read(path string) (GranuleMeta, error) {
+	meta, err := r.Primary.Read(path)
+	if nil == err {
+		return meta, nil
+	}
+	logger.Warn("primary HDF5 reader failed, falling back", zap.String("path", path), zap.Error(err))
+	return r.Secondary.Read(path)
+}
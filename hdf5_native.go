@@ -0,0 +1,123 @@
+//go:build cgo
+
+package main
+
+import (
+	"go.uber.org/zap"
+	"gonum.org/v1/hdf5"
+)
+
+// NativeHDF5Reader opens the SVM10 file directly via cgo bindings to
+// libhdf5. It requires CGO_ENABLED=1 and libhdf5-dev at build time;
+// builds without cgo get the stub in hdf5_native_nocgo.go instead.
+type NativeHDF5Reader struct{}
+
+func (r *NativeHDF5Reader) Read(path string) (GranuleMeta, error) {
+	f, err := hdf5.OpenFile(path, hdf5.F_ACC_RDONLY)
+	if nil != err {
+		return GranuleMeta{}, NativeReadFailed
+	}
+	defer f.Close()
+
+	group, err := f.OpenGroup("/All_Data/VIIRS-M10-SDR_All")
+	if nil != err {
+		return GranuleMeta{}, NativeReadFailed
+	}
+	defer group.Close()
+
+	attr, err := group.OpenAttribute("Ascending/Descending_Indicator")
+	if nil != err {
+		return GranuleMeta{}, NativeReadFailed
+	}
+	defer attr.Close()
+
+	var indicator uint8
+	if err := attr.Read(&indicator, hdf5.T_NATIVE_UCHAR); nil != err {
+		return GranuleMeta{}, NativeReadFailed
+	}
+	meta := GranuleMeta{Night: 0 != indicator}
+	r.readGranuleMeta(f, path, &meta)
+	return meta, nil
+}
+
+// readGranuleMeta best-effort populates the start/end time, orbit number,
+// and bounding box of meta from the granule-level metadata groups. Each
+// attribute is independent: a missing or malformed one is logged and left
+// zero rather than failing the whole read, since only Night gates whether
+// a granule is processed at all.
+func (r *NativeHDF5Reader) readGranuleMeta(f *hdf5.File, path string, meta *GranuleMeta) {
+	aggr, err := f.OpenGroup("/Data_Products/VIIRS-M10-SDR/VIIRS-M10-SDR_Aggr")
+	if nil != err {
+		logger.Warn("failed to open aggregate metadata group", zap.String("path", path), zap.Error(err))
+	} else {
+		defer aggr.Close()
+		beginDate := readStringAttr(aggr, "Beginning_Date", path)
+		beginTime := readStringAttr(aggr, "Beginning_Time", path)
+		if start, terr := parseGranuleTime(beginDate, beginTime); nil == terr {
+			meta.StartTime = start
+		} else if "" != beginDate || "" != beginTime {
+			logger.Warn("failed to parse granule start time", zap.String("path", path), zap.Error(terr))
+		}
+		endDate := readStringAttr(aggr, "Ending_Date", path)
+		endTime := readStringAttr(aggr, "Ending_Time", path)
+		if end, terr := parseGranuleTime(endDate, endTime); nil == terr {
+			meta.EndTime = end
+		} else if "" != endDate || "" != endTime {
+			logger.Warn("failed to parse granule end time", zap.String("path", path), zap.Error(terr))
+		}
+		meta.OrbitNumber = readIntAttr(aggr, "N_Beginning_Orbit_Number", path)
+	}
+
+	gran, err := f.OpenGroup("/Data_Products/VIIRS-M10-SDR/VIIRS-M10-SDR_Gran_0")
+	if nil != err {
+		logger.Warn("failed to open granule metadata group", zap.String("path", path), zap.Error(err))
+		return
+	}
+	defer gran.Close()
+	meta.BoundingBox.MaxLat = readDoubleAttr(gran, "North_Bounding_Coordinate", path)
+	meta.BoundingBox.MinLat = readDoubleAttr(gran, "South_Bounding_Coordinate", path)
+	meta.BoundingBox.MaxLon = readDoubleAttr(gran, "East_Bounding_Coordinate", path)
+	meta.BoundingBox.MinLon = readDoubleAttr(gran, "West_Bounding_Coordinate", path)
+}
+
+func readStringAttr(group *hdf5.Group, name, path string) string {
+	attr, err := group.OpenAttribute(name)
+	if nil != err {
+		return ""
+	}
+	defer attr.Close()
+	var v string
+	if err := attr.Read(&v, nil); nil != err {
+		logger.Warn("failed to read string attribute", zap.String("path", path), zap.String("attr", name), zap.Error(err))
+		return ""
+	}
+	return v
+}
+
+func readIntAttr(group *hdf5.Group, name, path string) int {
+	attr, err := group.OpenAttribute(name)
+	if nil != err {
+		return 0
+	}
+	defer attr.Close()
+	var v int32
+	if err := attr.Read(&v, hdf5.T_NATIVE_INT32); nil != err {
+		logger.Warn("failed to read int attribute", zap.String("path", path), zap.String("attr", name), zap.Error(err))
+		return 0
+	}
+	return int(v)
+}
+
+func readDoubleAttr(group *hdf5.Group, name, path string) float64 {
+	attr, err := group.OpenAttribute(name)
+	if nil != err {
+		return 0
+	}
+	defer attr.Close()
+	var v float64
+	if err := attr.Read(&v, hdf5.T_NATIVE_DOUBLE); nil != err {
+		logger.Warn("failed to read float attribute", zap.String("path", path), zap.String("attr", name), zap.Error(err))
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,12 @@
+//go:build !cgo
+
+package main
+
+// NativeHDF5Reader is a stub for builds without cgo (and therefore
+// without libhdf5). HDF5ReaderType "native" or "auto" still select it, but
+// every Read fails so FallbackHDF5Reader always drops to H5DumpReader.
+type NativeHDF5Reader struct{}
+
+func (r *NativeHDF5Reader) Read(path string) (GranuleMeta, error) {
+	return GranuleMeta{}, NativeReadFailed
+}
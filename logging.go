@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logger is the process-wide structured logger. InitLogger rebuilds it
+// from Config.LogLevel/LogFormat once the config has been decoded; until
+// then it's a sane default so early startup code can still log.
+var logger = zap.NewExample()
+
+// InitLogger rebuilds the package-level logger per cfg.LogLevel (debug,
+// info, warn, error; default info) and cfg.LogFormat (text or json;
+// default text).
+func InitLogger(cfg Config) error {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); nil != err {
+		return err
+	}
+	encoderCfg := zap.NewProductionEncoderConfig()
+	encoderCfg.TimeKey = "ts"
+	encoderCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	var encoder zapcore.Encoder
+	switch strings.ToLower(cfg.LogFormat) {
+	case "text":
+		encoder = zapcore.NewConsoleEncoder(encoderCfg)
+	case "json":
+		encoder = zapcore.NewJSONEncoder(encoderCfg)
+	default:
+		return fmt.Errorf("viirs_watcher: unknown log format %q", cfg.LogFormat)
+	}
+	logger = zap.New(zapcore.NewCore(encoder, zapcore.Lock(os.Stdout), level))
+	return nil
+}
+
+// granuleLogger annotates logger with a granule's identifying fields.
+func granuleLogger(s *State) *zap.Logger {
+	return logger.With(zap.String("granule_id", s.Id), zap.String("m10_file", s.M10File))
+}
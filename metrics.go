@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// NewMetricsServer builds the /metrics scrape endpoint as its own server,
+// independent of the admin endpoint's address, so a deployment can expose
+// Prometheus metrics without also opting into /status and /cancel/{id}.
+func NewMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+var (
+	granulesReceivedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viirs_granules_received_total",
+		Help: "Count of file notifications received, by status.",
+	}, []string{"status"})
+
+	granulesProcessedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viirs_granules_processed_total",
+		Help: "Count of granules dispatched to a Handler, by result.",
+	}, []string{"result"})
+
+	processDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "viirs_process_duration_seconds",
+		Help: "Time spent running a granule's Handler, start to finish.",
+	})
+
+	detectDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "viirs_detect_duration_seconds",
+		Help: "Time spent running the detect binary.",
+	})
+
+	fitDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "viirs_fit_duration_seconds",
+		Help: "Time spent running the fit binary.",
+	})
+
+	awaitingGranules = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "viirs_awaiting_granules",
+		Help: "Granules currently waiting on more required files.",
+	})
+
+	watcherErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "viirs_watcher_errors_total",
+		Help: "Count of watcher errors, by source.",
+	}, []string{"source"})
+)
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Tracker records which granules are awaiting more files and which are
+// currently being processed, so the admin endpoints can report on both
+// without reaching into work()'s internal state.
+type Tracker struct {
+	mu       sync.Mutex
+	awaiting map[string]*State
+	inflight map[string]context.CancelFunc
+	claimed  map[string]struct{}
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		awaiting: make(map[string]*State),
+		inflight: make(map[string]context.CancelFunc),
+		claimed:  make(map[string]struct{}),
+	}
+}
+
+func (t *Tracker) SetAwaiting(s *State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.awaiting[s.Id] = s
+	awaitingGranules.Set(float64(len(t.awaiting)))
+}
+
+func (t *Tracker) DropAwaiting(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.awaiting, id)
+	awaitingGranules.Set(float64(len(t.awaiting)))
+}
+
+func (t *Tracker) StartInFlight(id string, cancel context.CancelFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.awaiting, id)
+	awaitingGranules.Set(float64(len(t.awaiting)))
+	t.inflight[id] = cancel
+}
+
+func (t *Tracker) FinishInFlight(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inflight, id)
+}
+
+// Claim reports whether id was successfully claimed, i.e. no earlier
+// attempt for the same granule is still queued, backing off, or in
+// flight. Submit calls this before enqueueing so a granule redelivered
+// while an earlier attempt is still running can't be dispatched
+// concurrently with it.
+func (t *Tracker) Claim(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.claimed[id]; ok {
+		return false
+	}
+	t.claimed[id] = struct{}{}
+	return true
+}
+
+// Release frees a claim taken by Claim, once the claimed granule's
+// attempt has finished.
+func (t *Tracker) Release(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.claimed, id)
+}
+
+// Cancel cancels the in-flight granule id, if any. It reports whether a
+// matching granule was found.
+func (t *Tracker) Cancel(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cancel, ok := t.inflight[id]
+	if !ok {
+		return false
+	}
+	cancel()
+	return true
+}
+
+// Status is a point-in-time snapshot of tracked granules, for /status.
+type Status struct {
+	Awaiting []string `json:"awaiting"`
+	InFlight []string `json:"in_flight"`
+}
+
+func (t *Tracker) Status() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := Status{}
+	for id := range t.awaiting {
+		status.Awaiting = append(status.Awaiting, id)
+	}
+	for id := range t.inflight {
+		status.InFlight = append(status.InFlight, id)
+	}
+	return status
+}
+
+// Pool is a bounded worker pool that dispatches ready *State values
+// through Process. Submit blocks once cfg.Concurrency workers are all
+// busy, giving the watcher backpressure instead of unbounded goroutines.
+type Pool struct {
+	ctx     context.Context
+	cfg     Config
+	store   StateStore
+	tracker *Tracker
+	jobs    chan *State
+	done    chan string
+	wg      sync.WaitGroup
+}
+
+func NewPool(ctx context.Context, cfg Config, store StateStore, tracker *Tracker) *Pool {
+	p := &Pool{
+		ctx:     ctx,
+		cfg:     cfg,
+		store:   store,
+		tracker: tracker,
+		jobs:    make(chan *State, cfg.Concurrency),
+		done:    make(chan string, cfg.Concurrency),
+	}
+	for i := 0; i < cfg.Concurrency; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	return p
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case s := <-p.jobs:
+			p.process(s)
+		}
+	}
+}
+
+// Wait blocks until every worker has exited. Workers exit once p.ctx is
+// cancelled and their current granule (if any) finishes, so callers
+// should cancel ctx first and call Wait before tearing down anything
+// (e.g. the state store) that a still-running p.process might touch.
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
+
+func (p *Pool) process(s *State) {
+	glog := granuleLogger(s)
+	ctx := p.ctx
+	var cancel context.CancelFunc
+	if "" != p.cfg.ProcessTimeout {
+		if d, err := time.ParseDuration(p.cfg.ProcessTimeout); nil == err {
+			ctx, cancel = context.WithTimeout(ctx, d)
+		} else {
+			glog.Warn("failed to parse ProcessTimeout, running without one", zap.Error(err))
+		}
+	}
+	if nil == cancel {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	p.tracker.StartInFlight(s.Id, cancel)
+
+	start := time.Now()
+	glog.Info("event=start")
+	dispatch(ctx, p.cfg, p.store, s)
+	glog.Info("event=finish", zap.Duration("duration", time.Since(start)))
+
+	p.tracker.FinishInFlight(s.Id)
+	p.tracker.Release(s.Id)
+	p.done <- s.Id
+}
+
+// Submit enqueues s for processing, blocking until a worker is free. It
+// reports whether s was accepted; a granule already queued, backing off,
+// or in flight under the same Id is refused rather than run concurrently
+// with the attempt still in progress. A caller holding a refused s should
+// retry once Done() reports that Id.
+func (p *Pool) Submit(s *State) bool {
+	if !p.tracker.Claim(s.Id) {
+		return false
+	}
+	p.jobs <- s
+	return true
+}
+
+// Done reports the Id of each granule once its Pool attempt (successful
+// or not) has finished and its claim has been released.
+func (p *Pool) Done() <-chan string {
+	return p.done
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var statesBucket = []byte("states")
+
+// StateStore persists in-flight granule State so a restart doesn't lose
+// partially-arrived files: work() reloads every pending State on startup
+// instead of waiting for every required file to be redelivered.
+type StateStore interface {
+	Put(s *State) error
+	Delete(id string) error
+	List() ([]*State, error)
+	Close() error
+}
+
+// BoltStateStore is the default StateStore, backed by a single BoltDB file.
+type BoltStateStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStateStore(path string) (*BoltStateStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if nil != err {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(statesBucket)
+		return err
+	})
+	if nil != err {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStateStore{db: db}, nil
+}
+
+func (b *BoltStateStore) Put(s *State) error {
+	data, err := json.Marshal(s)
+	if nil != err {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(statesBucket).Put([]byte(s.Id), data)
+	})
+}
+
+func (b *BoltStateStore) Delete(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(statesBucket).Delete([]byte(id))
+	})
+}
+
+func (b *BoltStateStore) List() ([]*State, error) {
+	var states []*State
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(statesBucket).ForEach(func(k, v []byte) error {
+			var s State
+			if err := json.Unmarshal(v, &s); nil != err {
+				return err
+			}
+			states = append(states, &s)
+			return nil
+		})
+	})
+	return states, err
+}
+
+func (b *BoltStateStore) Close() error {
+	return b.db.Close()
+}
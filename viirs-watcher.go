@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"golang.org/x/exp/inotify"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 var (
@@ -22,21 +28,25 @@ var (
 	FitFailed        = errors.New("Fit binary launch failed.")
 	NightCheckFailed = errors.New("Failed to check if night data provided.")
 	NoNightData      = errors.New("File provided does not contain nighttime data.")
+	OutsideAOI       = errors.New("Granule bounding box does not intersect configured AOI.")
 )
 
 const DefaultPeriod = 30 * time.Second
+const DefaultRetryBackoff = 30 * time.Second
+const DefaultMaxRetries = 3
 
 var (
-	version       = "v2.1"
-	defaultPath   = "."
-	defaultDetect = "viirs_detect"
-	defaultFit    = "viirs_fit"
-	m10           = "SVM10"
+	version        = "v2.1"
+	defaultPath    = "."
+	defaultDetect  = "viirs_detect"
+	defaultFit     = "viirs_fit"
+	m10            = "SVM10"
+	defaultStateDB = "viirs_watcher.db"
 )
 
 const (
-	Inotify = "inotify"
-	Timed   = "timed"
+	Fsnotify = "fsnotify"
+	Timed    = "timed"
 )
 
 type Config struct {
@@ -45,13 +55,28 @@ type Config struct {
 		Period      string
 		WatchDir    string
 		SubWatchDir string
+		Patterns    []string
 	}
-	OutputDir    string
-	DetectBinary string
-	FitBinary    string
-	H5DumpBinary string
-	ReduceBinary string
-	RequireFiles []string
+	OutputDir      string
+	DetectBinary   string
+	FitBinary      string
+	H5DumpBinary   string
+	ReduceBinary   string
+	RequireFiles   []string
+	Handlers       []HandlerRule
+	StateDBPath    string
+	MaxRetries     int
+	RetryBackoff   string
+	Concurrency    int
+	ProcessTimeout string
+	AdminAddr      string
+	MetricsAddr    string
+	HDF5ReaderType string
+	LogLevel       string
+	LogFormat      string
+	AOI            *BoundingBox
+
+	reader HDF5Reader
 }
 
 func (c *Config) Constrain() {
@@ -65,17 +90,58 @@ func (c *Config) Constrain() {
 		c.OutputDir = defaultPath
 	}
 	if "" == c.Watcher.Type {
-		c.Watcher.Type = "inotify"
+		c.Watcher.Type = Fsnotify
 	}
 	if "" == c.Watcher.WatchDir {
 		c.Watcher.WatchDir = defaultPath
 	}
+	if 0 == len(c.Watcher.Patterns) {
+		c.Watcher.Patterns = []string{filepath.Join(c.Watcher.WatchDir, c.Watcher.SubWatchDir, "**", "SVM10_*.h5")}
+	}
 	if "" == c.DetectBinary {
 		c.DetectBinary = defaultDetect
 	}
 	if "" == c.FitBinary {
 		c.FitBinary = defaultFit
 	}
+	if "" == c.StateDBPath {
+		c.StateDBPath = defaultStateDB
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = DefaultMaxRetries
+	}
+	if "" == c.RetryBackoff {
+		c.RetryBackoff = DefaultRetryBackoff.String()
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = runtime.NumCPU()
+	}
+	if "" == c.HDF5ReaderType {
+		c.HDF5ReaderType = "auto"
+	}
+	if "" == c.LogLevel {
+		c.LogLevel = "info"
+	}
+	if "" == c.LogFormat {
+		c.LogFormat = "text"
+	}
+}
+
+// BuildHDF5Reader selects the HDF5Reader implementation named by
+// HDF5ReaderType. Call it once after Constrain.
+func (c *Config) BuildHDF5Reader() error {
+	h5dumpReader := &H5DumpReader{Binary: c.H5DumpBinary}
+	switch strings.ToLower(c.HDF5ReaderType) {
+	case "h5dump":
+		c.reader = h5dumpReader
+	case "native":
+		c.reader = &NativeHDF5Reader{}
+	case "auto":
+		c.reader = &FallbackHDF5Reader{Primary: &NativeHDF5Reader{}, Secondary: h5dumpReader}
+	default:
+		return fmt.Errorf("viirs_watcher: unknown hdf5 reader type %q", c.HDF5ReaderType)
+	}
+	return nil
 }
 
 func (c *Config) Done(s *State) bool {
@@ -85,51 +151,57 @@ func (c *Config) Done(s *State) bool {
 	}
 	for _, b := range c.RequireFiles {
 		if _, ok := index[b]; !ok {
-			log.Printf("State %s incomplete at least %s left.", s.Id, b)
+			granuleLogger(s).Debug("state incomplete", zap.String("missing", b))
 			return false
 		}
 	}
 	return true
 }
 
-func (c *Config) hasNight(s *State) (bool, error) {
-	h5dump := exec.Command(c.H5DumpBinary, "-x", "-A", s.M10File)
-	out, err := h5dump.Output()
+// Process runs the built-in viirs_detect/viirs_fit pipeline against s. It
+// is exposed on Config so DetectFitHandler can wrap it as a Handler.
+func (c *Config) Process(ctx context.Context, s *State) error {
+	glog := granuleLogger(s)
+	meta, err := c.reader.Read(s.M10File)
 	if nil != err {
-		log.Printf("H5Dump failed: %s\n", err.Error())
-		return true, NightCheckFailed
-	}
-	if strings.Contains(string(out), "Descending_Indicator") {
-		return true, nil
-	}
-	return false, nil
-}
-
-func (c *Config) Process(s *State) error {
-	if night, err := c.hasNight(s); nil == err && !night {
-		return NoNightData
+		glog.Warn("HDF5 read failed", zap.Error(err))
+	} else {
+		s.Meta = &meta
+		if !meta.Night {
+			return NoNightData
+		}
+		if nil != c.AOI && !meta.BoundingBox.Intersects(*c.AOI) {
+			return OutsideAOI
+		}
 	}
 	detfile := filepath.Join(c.OutputDir, strings.Join([]string{"VNFD", s.Id, version}, "_")) + ".csv"
-	detect := exec.Command(c.DetectBinary, s.M10File, "-output", detfile, "-cloud", "0")
+	detect := exec.CommandContext(ctx, c.DetectBinary, s.M10File, "-output", detfile, "-cloud", "0")
+	detectStart := time.Now()
 	out, err := detect.Output()
+	detectDurationSeconds.Observe(time.Since(detectStart).Seconds())
 	if nil != err {
-		log.Printf("DEBUG Detect output: %s\n", string(out))
+		glog.Warn("detect failed", zap.ByteString("output", out), zap.Error(err))
 		return DetectFailed
 	}
 	fitfile := filepath.Join(c.OutputDir, strings.Join([]string{"VNFL", s.Id, version}, "_")) + ".csv"
-	fit := exec.Command(c.FitBinary, detfile, "-output", fitfile, "-plot", "1", "-map", "1", "-localmax", "1", "-size", "100", "-font", "10")
+	fit := exec.CommandContext(ctx, c.FitBinary, detfile, "-output", fitfile, "-plot", "1", "-map", "1", "-localmax", "1", "-size", "100", "-font", "10")
+	fitStart := time.Now()
 	out, err = fit.Output()
+	fitDurationSeconds.Observe(time.Since(fitStart).Seconds())
 	if nil != err {
-		log.Printf("DEBUG Fit output: %s\n", string(out))
+		glog.Warn("fit failed", zap.ByteString("output", out), zap.Error(err))
 		return FitFailed
 	}
 	return nil
 }
 
 type State struct {
-	Id      string
-	M10File string
-	Files   []string
+	Id        string
+	M10File   string
+	Files     []string
+	FilePaths map[string]string
+	Retries   int
+	Meta      *GranuleMeta
 }
 
 func NewState(fp string) (*State, error) {
@@ -141,6 +213,7 @@ func NewState(fp string) (*State, error) {
 	}
 	s.Id = strings.Join(parts[1:5], "_")
 	s.Files = append(s.Files, parts[0])
+	s.FilePaths = map[string]string{parts[0]: fp}
 	if parts[0] == m10 {
 		s.M10File = fp
 	}
@@ -152,6 +225,12 @@ func (s *State) Merge(s2 *State) error {
 		return IdMissmatch
 	}
 	s.Files = append(s.Files, s2.Files...)
+	if nil == s.FilePaths {
+		s.FilePaths = make(map[string]string)
+	}
+	for token, path := range s2.FilePaths {
+		s.FilePaths[token] = path
+	}
 	if s.M10File == "" {
 		s.M10File = s2.M10File
 	}
@@ -163,40 +242,177 @@ type Notification struct {
 	OnProcess func()
 }
 
-func work(cfg Config, notifications <-chan Notification) {
-	awaiting := make(map[string]*State)
-	for notif := range notifications {
-		f := notif.File
-		s, err := NewState(f)
-		if nil != err {
-			log.Printf("State creation fail: %s for %s\n", err.Error(), f)
+// reconcileState drops any tracked file that no longer exists on disk, so
+// a granule that lost one of its required files between restarts waits
+// for redelivery instead of being dispatched against a stale path.
+func reconcileState(s *State) {
+	for token, path := range s.FilePaths {
+		if _, err := os.Stat(path); nil == err {
 			continue
 		}
-		if s2, ok := awaiting[s.Id]; ok {
-			s.Merge(s2)
+		granuleLogger(s).Info("lost required file, waiting for redelivery", zap.String("file_type", token))
+		delete(s.FilePaths, token)
+		filtered := s.Files[:0]
+		for _, f := range s.Files {
+			if f != token {
+				filtered = append(filtered, f)
+			}
 		}
-		awaiting[s.Id] = s
-		if !cfg.Done(s) {
-			continue
+		s.Files = filtered
+		if token == m10 {
+			s.M10File = ""
+		}
+	}
+}
+
+// retryBackoff returns how long to wait before retrying a granule that has
+// already failed retries times, growing exponentially off cfg.RetryBackoff.
+func retryBackoff(cfg Config, retries int) time.Duration {
+	if 0 == retries {
+		return 0
+	}
+	base, err := time.ParseDuration(cfg.RetryBackoff)
+	if nil != err {
+		base = DefaultRetryBackoff
+	}
+	return base * time.Duration(uint(1)<<uint(retries-1))
+}
+
+// dispatch runs s through its configured Handler under ctx, persisting
+// Retries and quarantining it in store once cfg.MaxRetries is exceeded so
+// a permanently-broken granule isn't reprocessed on every restart.
+func dispatch(ctx context.Context, cfg Config, store StateStore, s *State) {
+	glog := granuleLogger(s)
+	if backoff := retryBackoff(cfg, s.Retries); backoff > 0 {
+		glog.Info("backing off before retry", zap.Duration("backoff", backoff), zap.Int("retries", s.Retries))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			glog.Info("cancelled during retry backoff", zap.Error(ctx.Err()))
+			return
 		}
-		log.Printf("Granule %s ready for processing.\n", s.Id)
-		delete(awaiting, s.Id)
-		if err = cfg.Process(s); nil != err {
-			log.Printf("Processing failed: %s for %s\n", err.Error(), s.Id)
+	}
+	handleStart := time.Now()
+	err := cfg.HandlerFor(s).Handle(ctx, s)
+	processDurationSeconds.Observe(time.Since(handleStart).Seconds())
+	if nil == err {
+		granulesProcessedTotal.WithLabelValues("success").Inc()
+		if nil != store {
+			if derr := store.Delete(s.Id); nil != derr {
+				glog.Warn("failed to delete persisted state", zap.Error(derr))
+			}
+		}
+		return
+	}
+	glog.Warn("processing failed", zap.Error(err))
+	s.Retries++
+	if s.Retries > cfg.MaxRetries {
+		granulesProcessedTotal.WithLabelValues("quarantined").Inc()
+		glog.Warn("granule quarantined", zap.Int("retries", s.Retries))
+		if nil != store {
+			if derr := store.Delete(s.Id); nil != derr {
+				glog.Warn("failed to delete quarantined state", zap.Error(derr))
+			}
+		}
+		return
+	}
+	granulesProcessedTotal.WithLabelValues("failure").Inc()
+	if nil != store && nil != store.Put(s) {
+		glog.Warn("failed to persist retry state")
+	}
+}
+
+// trySubmit submits awaiting[id] if it's ready (marked so in onReady) and
+// pool.Submit accepts it. Submit refuses an Id already claimed by an
+// earlier attempt still queued, backing off, or in flight; on refusal the
+// state stays in awaiting and is retried once pool.Done() reports that
+// Id, so a granule redelivered mid-attempt waits instead of running
+// concurrently with it.
+func trySubmit(pool *Pool, awaiting map[string]*State, onReady map[string]func(), id string) {
+	s, ok := awaiting[id]
+	if !ok {
+		return
+	}
+	onProcess, ready := onReady[id]
+	if !ready {
+		return
+	}
+	if !pool.Submit(s) {
+		return
+	}
+	delete(awaiting, id)
+	delete(onReady, id)
+	pool.tracker.DropAwaiting(id)
+	onProcess()
+}
+
+func work(cfg Config, store StateStore, pool *Pool, notifications <-chan Notification) {
+	awaiting := make(map[string]*State)
+	onReady := make(map[string]func())
+	if nil != store {
+		pending, err := store.List()
+		if nil != err {
+			logger.Warn("failed to load persisted state", zap.Error(err))
+		}
+		for _, s := range pending {
+			reconcileState(s)
+			if cfg.Done(s) {
+				awaiting[s.Id] = s
+				onReady[s.Id] = func() {}
+				trySubmit(pool, awaiting, onReady, s.Id)
+				continue
+			}
+			awaiting[s.Id] = s
+			pool.tracker.SetAwaiting(s)
+		}
+	}
+	for {
+		select {
+		case notif, ok := <-notifications:
+			if !ok {
+				logger.Info("notifications channel closed, all done")
+				return
+			}
+			f := notif.File
+			s, err := NewState(f)
+			if nil != err {
+				granulesReceivedTotal.WithLabelValues("invalid").Inc()
+				logger.Warn("state creation failed", zap.String("file", f), zap.Error(err))
+				continue
+			}
+			granulesReceivedTotal.WithLabelValues("accepted").Inc()
+			if s2, ok := awaiting[s.Id]; ok {
+				s.Merge(s2)
+			}
+			awaiting[s.Id] = s
+			pool.tracker.SetAwaiting(s)
+			if nil != store {
+				if err = store.Put(s); nil != err {
+					granuleLogger(s).Warn("failed to persist state", zap.Error(err))
+				}
+			}
+			if !cfg.Done(s) {
+				continue
+			}
+			granuleLogger(s).Info("granule ready for processing")
+			onReady[s.Id] = notif.OnProcess
+			trySubmit(pool, awaiting, onReady, s.Id)
+		case id := <-pool.Done():
+			trySubmit(pool, awaiting, onReady, id)
 		}
-		notif.OnProcess()
 	}
-	log.Printf("Notifications channel closed. All done. \n")
 }
 
-func workLayout(cfg Config, dirs <-chan string) {
+func workLayout(cfg Config, store StateStore, pool *Pool, dirs <-chan string) {
 	var watchers []*LayoutWatcher
 	notifications := make(chan Notification)
-	go work(cfg, notifications)
+	go work(cfg, store, pool, notifications)
 	for d := range dirs {
 		period, err := time.ParseDuration(cfg.Watcher.Period)
 		if nil != err {
-			log.Printf("Failed to parse period, failing back to default %s\n", DefaultPeriod)
+			logger.Warn("failed to parse period, falling back to default", zap.Duration("default", DefaultPeriod))
 			period = DefaultPeriod
 		}
 		lw := NewLayoutWatcher(period)
@@ -212,25 +428,26 @@ func workLayout(cfg Config, dirs <-chan string) {
 				go func() {
 					finfo, err := os.Stat(file)
 					if nil != err {
-						log.Println(err)
+						logger.Warn("failed to stat file", zap.String("file", file), zap.Error(err))
 						return
 					}
 					osz := finfo.Size()
 					<-time.After(10 * time.Second)
 					finfo, err = os.Stat(file)
 					if nil != err {
-						log.Println(err)
+						logger.Warn("failed to stat file", zap.String("file", file), zap.Error(err))
 						return
 					}
 					if finfo.Size() == osz {
-						notifications <- Notification{file, lw.Close}
+						notifications <- Notification{file, func() { lw.Close() }}
 					}
 				}()
 			case err, ok := <-lw.Error():
 				if !ok {
 					break FILE_LOOP
 				}
-				log.Println(err.Error())
+				watcherErrorsTotal.WithLabelValues("timed").Inc()
+				logger.Warn("watcher error", zap.Error(err))
 			}
 		}
 	}
@@ -265,11 +482,12 @@ func (lw *LayoutWatcher) Error() <-chan error {
 	return lw.err
 }
 
-func (lw *LayoutWatcher) Close() {
+func (lw *LayoutWatcher) Close() error {
 	for k := range lw.done {
 		close(lw.done[k])
 	}
 	lw.wg.Wait()
+	return nil
 }
 
 func (lw *LayoutWatcher) AddWatch(path string) {
@@ -328,48 +546,79 @@ func main() {
 		fcfg.Close()
 	}
 	cfg.Constrain()
+	if err := InitLogger(cfg); nil != err {
+		log.Panicf("Failed to configure logger: %s\n", err.Error())
+	}
+	if err := cfg.BuildHandlers(); nil != err {
+		logger.Panic("failed to build handlers", zap.Error(err))
+	}
+	if err := cfg.BuildHDF5Reader(); nil != err {
+		logger.Panic("failed to build HDF5 reader", zap.Error(err))
+	}
+	store, err := NewBoltStateStore(cfg.StateDBPath)
+	if nil != err {
+		logger.Panic("failed to open state store", zap.Error(err))
+	}
+	defer store.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	tracker := NewTracker()
+	pool := NewPool(ctx, cfg, store, tracker)
+	if "" != cfg.AdminAddr {
+		admin := NewAdminServer(cfg.AdminAddr, tracker)
+		go func() {
+			if err := admin.ListenAndServe(); nil != err && http.ErrServerClosed != err {
+				logger.Warn("admin server error", zap.Error(err))
+			}
+		}()
+		logger.Info("admin endpoint listening", zap.String("addr", cfg.AdminAddr))
+	}
+	if "" != cfg.MetricsAddr {
+		metrics := NewMetricsServer(cfg.MetricsAddr)
+		go func() {
+			if err := metrics.ListenAndServe(); nil != err && http.ErrServerClosed != err {
+				logger.Warn("metrics server error", zap.Error(err))
+			}
+		}()
+		logger.Info("metrics endpoint listening", zap.String("addr", cfg.MetricsAddr))
+	}
 	switch strings.ToLower(cfg.Watcher.Type) {
-	case Inotify:
-		watcher, err := inotify.NewWatcher()
-		defer watcher.Close()
+	case Fsnotify:
+		watcher, err := NewFSWatcher(cfg.Watcher.WatchDir, cfg.Watcher.Patterns)
 		if nil != err {
-			log.Panicf("Failed to start watcher: %s\n", err.Error())
-		}
-		if err = watcher.AddWatch(cfg.Watcher.WatchDir, inotify.IN_CLOSE_WRITE); nil != err {
-			log.Panicf("Failed to start watching directory: %s\n", err.Error())
+			logger.Panic("failed to start watcher", zap.Error(err))
 		}
+		defer watcher.Close()
 		notifications := make(chan Notification)
-		go work(cfg, notifications)
-		log.Printf("Watching: %s\n", cfg.Watcher.WatchDir)
+		go work(cfg, store, pool, notifications)
+		logger.Info("watching", zap.String("dir", cfg.Watcher.WatchDir), zap.Strings("patterns", cfg.Watcher.Patterns))
 		go func() {
 		EVENT_LOOP:
 			for {
 				select {
-				case event, ok := <-watcher.Event:
+				case file, ok := <-watcher.Event():
 					if !ok {
 						break EVENT_LOOP
 					}
-					if event.Mask&inotify.IN_CLOSE_WRITE == inotify.IN_CLOSE_WRITE && event.Name != cfg.Watcher.WatchDir {
-						notifications <- Notification{event.Name, func() {}}
-					}
-				case e, ok := <-watcher.Error:
+					notifications <- Notification{file, func() {}}
+				case e, ok := <-watcher.Error():
 					if !ok {
 						break EVENT_LOOP
 					}
-					log.Printf("Watcher error: %s", e.Error())
+					watcherErrorsTotal.WithLabelValues("fsnotify").Inc()
+					logger.Warn("watcher error", zap.Error(e))
 				}
 			}
 		}()
 	case Timed:
 		period, err := time.ParseDuration(cfg.Watcher.Period)
 		if nil != err {
-			log.Printf("Failed to parse period, failing back to default %s\n", DefaultPeriod)
+			logger.Warn("failed to parse period, falling back to default", zap.Duration("default", DefaultPeriod))
 			period = DefaultPeriod
 		}
 		watcher := NewLayoutWatcher(period)
 		defer watcher.Close()
 		watcher.AddWatch(cfg.Watcher.WatchDir)
-		go workLayout(cfg, watcher.Event())
+		go workLayout(cfg, store, pool, watcher.Event())
 		go func() {
 		EVENT_LOOP:
 			for {
@@ -377,11 +626,15 @@ func main() {
 				if !ok {
 					break EVENT_LOOP
 				}
-				log.Printf("Watcher error: %s", e.Error())
+				watcherErrorsTotal.WithLabelValues("timed").Inc()
+				logger.Warn("watcher error", zap.Error(e))
 			}
 		}()
 	}
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
+	logger.Info("signal received, cancelling in-flight processing")
+	cancel()
+	pool.Wait()
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/fsnotify.v1"
+)
+
+// stabilityDelay is how long FSWatcher waits, after a matching file's last
+// Create/Write event, before re-stating it to check the size has stopped
+// changing. Mirrors the stat-twice-after-delay check workLayout already
+// does for the polling LayoutWatcher.
+const stabilityDelay = 10 * time.Second
+
+// Watcher is satisfied by every backend capable of telling work() when a
+// new file has landed. FSWatcher is the default; LayoutWatcher (polling)
+// is the fallback for filesystems fsnotify can't watch (NFS, some
+// container overlays).
+type Watcher interface {
+	Event() <-chan string
+	Error() <-chan error
+	Close() error
+}
+
+// FSWatcher walks root at startup, watches every matching directory, and
+// adds watches on new subdirectories as they appear.
+type FSWatcher struct {
+	patterns []string
+	fsw      *fsnotify.Watcher
+	event    chan string
+	err      chan error
+}
+
+// NewFSWatcher walks root, watches every directory under it, and emits on
+// Event() the path of any file matching one of patterns.
+func NewFSWatcher(root string, patterns []string) (*FSWatcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if nil != err {
+		return nil, err
+	}
+	w := &FSWatcher{
+		patterns: patterns,
+		fsw:      fsw,
+		event:    make(chan string),
+		err:      make(chan error),
+	}
+	if err = w.watchTree(root); nil != err {
+		fsw.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// watchTree registers a watch on dir and every directory beneath it.
+func (w *FSWatcher) watchTree(dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if nil != err {
+			return err
+		}
+		if info.IsDir() {
+			if err := w.fsw.Add(p); nil != err {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (w *FSWatcher) run() {
+	for {
+		select {
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			w.handle(ev)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			w.err <- err
+		}
+	}
+}
+
+func (w *FSWatcher) handle(ev fsnotify.Event) {
+	if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+		return
+	}
+	finfo, err := os.Stat(ev.Name)
+	if nil == err && finfo.IsDir() {
+		if ev.Op&fsnotify.Create != 0 {
+			if err := w.watchTree(ev.Name); nil != err {
+				watcherErrorsTotal.WithLabelValues("fsnotify").Inc()
+				logger.Warn("failed to watch new directory", zap.String("dir", ev.Name), zap.Error(err))
+			}
+		}
+		return
+	}
+	if w.matches(ev.Name) {
+		go w.emitWhenStable(ev.Name)
+	}
+}
+
+// emitWhenStable sends path on w.event once its size has stopped changing
+// for stabilityDelay, so a file still being written or copied in isn't
+// handed off truncated. fsnotify.v1 has no close-write event to wait on
+// instead.
+func (w *FSWatcher) emitWhenStable(path string) {
+	finfo, err := os.Stat(path)
+	if nil != err {
+		return
+	}
+	osz := finfo.Size()
+	time.Sleep(stabilityDelay)
+	finfo, err = os.Stat(path)
+	if nil != err {
+		return
+	}
+	if finfo.Size() == osz {
+		w.event <- path
+	}
+}
+
+func (w *FSWatcher) matches(path string) bool {
+	for _, pattern := range w.patterns {
+		if matchPattern(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *FSWatcher) Event() <-chan string {
+	return w.event
+}
+
+func (w *FSWatcher) Error() <-chan error {
+	return w.err
+}
+
+func (w *FSWatcher) Close() error {
+	return w.fsw.Close()
+}
+
+// matchPattern reports whether path satisfies pattern, where pattern is a
+// slash-separated glob that may contain "**" to match any number of
+// intermediate path elements (e.g. "NPP/**/result/SVM10_*.h5").
+func matchPattern(pattern, path string) bool {
+	pattern = filepath.ToSlash(pattern)
+	path = filepath.ToSlash(path)
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(path, "/"))
+}
+
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		if matchSegments(pattern[1:], path) {
+			return true
+		}
+		for i := range path {
+			if matchSegments(pattern[1:], path[i+1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	ok, err := filepath.Match(pattern[0], path[0])
+	if nil != err || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], path[1:])
+}